@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SQLConfig configures a database/sql-backed Storage.
+type SQLConfig struct {
+	Driver          string        `yaml:"driver"` // "postgres" or "sqlite"
+	DSN             string        `yaml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// RedisConfig configures a Redis-backed Storage.
+type RedisConfig struct {
+	Addr          string        `yaml:"addr"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	RevocationTTL time.Duration `yaml:"revocation_ttl"`
+}
+
+// EIP1271Config maps a chain id to the JSON-RPC endpoint Authenticate
+// should query when falling back to EIP-1271 smart-contract wallet
+// signature verification on that chain.
+type EIP1271Config struct {
+	RPCURLs map[int64]string `yaml:"rpc_urls"`
+}
+
+// Config is everything run() needs to stand up the server, loaded from an
+// optional YAML file with environment variables layered on top so
+// operators can override individual values (notably secrets) without
+// editing the file on disk.
+type Config struct {
+	// StorageBackend selects which Storage implementation run() wires up:
+	// "mem" (default), "sql" or "redis".
+	StorageBackend string        `yaml:"storage_backend"`
+	SQL            SQLConfig     `yaml:"sql"`
+	Redis          RedisConfig   `yaml:"redis"`
+	EIP1271        EIP1271Config `yaml:"eip1271"`
+	// PolicyFile is the path to the role policy document (see policy.go)
+	// that SigninHandler consults at signin time. It is watched for
+	// changes and hot-reloaded, so it is deliberately not itself part of
+	// this YAML-and-restart config.
+	PolicyFile string `yaml:"policy_file"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		StorageBackend: "mem",
+		SQL: SQLConfig{
+			Driver:          "sqlite",
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: time.Hour,
+		},
+		Redis: RedisConfig{
+			Addr:          "localhost:6379",
+			RevocationTTL: refreshTokenTTL,
+		},
+		EIP1271: EIP1271Config{
+			RPCURLs: map[int64]string{},
+		},
+	}
+}
+
+// LoadConfig loads Config from the YAML file at path (if path is non-empty
+// and the file exists), then applies environment variable overrides on top.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return cfg, err
+			}
+		} else if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	applyEnvOverrides(&cfg)
+	return cfg, nil
+}
+
+func applyEnvOverrides(cfg *Config) {
+	if v := os.Getenv("AUTH_STORAGE_BACKEND"); v != "" {
+		cfg.StorageBackend = v
+	}
+	if v := os.Getenv("AUTH_SQL_DRIVER"); v != "" {
+		cfg.SQL.Driver = v
+	}
+	if v := os.Getenv("AUTH_SQL_DSN"); v != "" {
+		cfg.SQL.DSN = v
+	}
+	if v := os.Getenv("AUTH_SQL_MAX_OPEN_CONNS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.SQL.MaxOpenConns = n
+		}
+	}
+	if v := os.Getenv("AUTH_SQL_MAX_IDLE_CONNS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.SQL.MaxIdleConns = n
+		}
+	}
+	if v := os.Getenv("AUTH_REDIS_ADDR"); v != "" {
+		cfg.Redis.Addr = v
+	}
+	if v := os.Getenv("AUTH_REDIS_PASSWORD"); v != "" {
+		cfg.Redis.Password = v
+	}
+	if v := os.Getenv("AUTH_REDIS_DB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.Redis.DB = n
+		}
+	}
+	if v := os.Getenv("AUTH_EIP1271_RPC_URLS"); v != "" {
+		cfg.EIP1271.RPCURLs = parseChainRPCURLs(v)
+	}
+	if v := os.Getenv("AUTH_POLICY_FILE"); v != "" {
+		cfg.PolicyFile = v
+	}
+}
+
+// parseChainRPCURLs parses a comma-separated "chainID=url,chainID=url"
+// list, the format AUTH_EIP1271_RPC_URLS uses since a YAML-style map
+// doesn't fit a flat environment variable. Entries that aren't of the
+// form "chainID=url" are skipped.
+func parseChainRPCURLs(v string) map[int64]string {
+	urls := make(map[int64]string)
+	for _, pair := range strings.Split(v, ",") {
+		k, url, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		chainID, err := strconv.ParseInt(strings.TrimSpace(k), 10, 64)
+		if err != nil {
+			continue
+		}
+		urls[chainID] = strings.TrimSpace(url)
+	}
+	return urls
+}
+
+// NewStorage builds the Storage implementation selected by cfg.StorageBackend.
+func NewStorage(cfg Config) (Storage, error) {
+	switch cfg.StorageBackend {
+	case "", "mem":
+		return NewMemStorage(), nil
+	case "sql":
+		db, err := sqlOpen(cfg.SQL)
+		if err != nil {
+			return nil, err
+		}
+		storage := NewSQLStorage(db, cfg.SQL.Driver)
+		if err := storage.Migrate(); err != nil {
+			return nil, err
+		}
+		return storage, nil
+	case "redis":
+		client := redisOpen(cfg.Redis)
+		return NewRedisStorage(client, cfg.Redis.RevocationTTL), nil
+	default:
+		return nil, ErrUnknownStorageBackend
+	}
+}
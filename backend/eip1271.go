@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ethCallTimeout bounds every outbound JSON-RPC dial/call ethCall makes.
+// Authenticate reaches ethCall on any /signin whose signature fails ECDSA
+// recovery, so an unbounded dial here would let a garbage signature pin a
+// goroutine on the operator's RPC node indefinitely.
+const ethCallTimeout = 5 * time.Second
+
+// rpcClients caches one ethclient.Client per RPC URL so repeated
+// ethCall invocations (one per failed-ECDSA signin, plus PolicyStore's
+// balance checks) reuse a connection instead of dialing fresh each time.
+var (
+	rpcClientsMu sync.Mutex
+	rpcClients   = map[string]*ethclient.Client{}
+)
+
+func dialRPC(ctx context.Context, rpcURL string) (*ethclient.Client, error) {
+	rpcClientsMu.Lock()
+	if client, ok := rpcClients[rpcURL]; ok {
+		rpcClientsMu.Unlock()
+		return client, nil
+	}
+	rpcClientsMu.Unlock()
+
+	client, err := ethclient.DialContext(ctx, rpcURL)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcClientsMu.Lock()
+	defer rpcClientsMu.Unlock()
+	if existing, ok := rpcClients[rpcURL]; ok {
+		client.Close()
+		return existing, nil
+	}
+	rpcClients[rpcURL] = client
+	return client, nil
+}
+
+// eip1271MagicValue is the 4-byte value isValidSignature must return to
+// signal that a signature is valid for the calling contract, per
+// https://eips.ethereum.org/EIPS/eip-1271.
+var eip1271MagicValue = [4]byte{0x16, 0x26, 0xba, 0x7a}
+
+// ErrEIP1271Unavailable is returned when Authenticate falls back to
+// EIP-1271 for a chain that has no configured RPC endpoint.
+var ErrEIP1271Unavailable = errors.New("no eip-1271 rpc endpoint configured for chain")
+
+// ethCall dials the JSON-RPC endpoint configured for chainID and performs
+// a single eth_call against to with data, returning the raw return value.
+// It is shared by the EIP-1271 signature check and PolicyStore's
+// on-chain balance rules (see policy.go), which both need a one-off
+// read-only contract call and nothing more.
+func ethCall(ctx context.Context, cfg EIP1271Config, chainID int64, to common.Address, data []byte) ([]byte, error) {
+	rpcURL, ok := cfg.RPCURLs[chainID]
+	if !ok || rpcURL == "" {
+		return nil, ErrEIP1271Unavailable
+	}
+	ctx, cancel := context.WithTimeout(ctx, ethCallTimeout)
+	defer cancel()
+	client, err := dialRPC(ctx, rpcURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.CallContract(ctx, ethereum.CallMsg{To: &to, Data: data}, nil)
+}
+
+// verifyEIP1271 calls isValidSignature(bytes32,bytes) on address over the
+// JSON-RPC endpoint configured for chainID and reports whether the
+// contract considers sig valid over hash. It is Authenticate's fallback
+// for smart-contract wallets (Safe, Argent, Ambire, ERC-4337 accounts)
+// that cannot produce a recoverable ECDSA signature.
+func verifyEIP1271(ctx context.Context, cfg EIP1271Config, chainID int64, address common.Address, hash [32]byte, sig []byte) (bool, error) {
+	data, err := eip1271CallData(hash, sig)
+	if err != nil {
+		return false, err
+	}
+	out, err := ethCall(ctx, cfg, chainID, address, data)
+	if err != nil {
+		return false, err
+	}
+	if len(out) < 4 {
+		return false, nil
+	}
+	var got [4]byte
+	copy(got[:], out[:4])
+	return got == eip1271MagicValue, nil
+}
+
+// eip1271CallData ABI-encodes a call to isValidSignature(bytes32,bytes).
+func eip1271CallData(hash [32]byte, sig []byte) ([]byte, error) {
+	bytes32Type, err := abi.NewType("bytes32", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	bytesType, err := abi.NewType("bytes", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	args := abi.Arguments{{Type: bytes32Type}, {Type: bytesType}}
+	packed, err := args.Pack(hash, sig)
+	if err != nil {
+		return nil, err
+	}
+	selector := crypto.Keccak256([]byte("isValidSignature(bytes32,bytes)"))[:4]
+	return append(selector, packed...), nil
+}
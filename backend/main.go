@@ -7,30 +7,64 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"math/big"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 var (
-	ErrUserNotExists  = errors.New("user does not exist")
-	ErrUserExists     = errors.New("user already exists")
-	ErrInvalidAddress = errors.New("invalid address")
-	ErrInvalidNonce   = errors.New("invalid nonce")
-	ErrMissingSig     = errors.New("signature is missing")
-	ErrAuthError      = errors.New("authentication error")
+	ErrUserNotExists               = errors.New("user does not exist")
+	ErrUserExists                  = errors.New("user already exists")
+	ErrInvalidAddress              = errors.New("invalid address")
+	ErrInvalidNonce                = errors.New("invalid nonce")
+	ErrMissingSig                  = errors.New("signature is missing")
+	ErrAuthError                   = errors.New("authentication error")
+	ErrRefreshTokenNotExists       = errors.New("refresh token does not exist")
+	ErrUnknownStorageBackend       = errors.New("unknown storage backend")
+	ErrWebAuthnCredentialNotExists = errors.New("webauthn credential does not exist")
+	ErrUnknownTracingExporter      = errors.New("unknown tracing exporter")
 )
 
+// AccessClaims extends the standard registered claims with the extra
+// information this server's access tokens carry.
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	MFAVerified bool     `json:"mfa_verified,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	// Purpose is empty for a normal access token. A non-empty value scopes
+	// the token to a single narrow use (see pendingMFAPurpose) and makes it
+	// unusable as a bearer token anywhere else; AuthMiddleware rejects any
+	// token that sets it.
+	Purpose string `json:"purpose,omitempty"`
+}
+
+// pendingMFAPurpose marks a token CreatePendingMFA issued: proof that the
+// caller already produced a verified SIWE signature for this address and
+// still owes the WebAuthn step-up SigninHandler found it needs. It is not
+// a bearer token - AuthMiddleware refuses anything with a non-empty
+// Purpose - it only unlocks LoginBeginHandler/LoginFinishHandler for the
+// exact address it was minted for.
+const pendingMFAPurpose = "mfa_pending"
+
+// pendingMFATTL bounds how long a caller has to complete the WebAuthn
+// ceremony after a verified SIWE signin before having to sign in again.
+const pendingMFATTL = 5 * time.Minute
+
 type JwtHmacProvider struct {
 	hmacSecret []byte
 	issuer     string
@@ -46,20 +80,69 @@ func NewJwtHmacProvider(hmacSecret string, issuer string, duration time.Duration
 	return &ans
 }
 
-func (j *JwtHmacProvider) CreateStandard(subject string) (string, error) {
+// CreateStandard issues a short-lived access token for subject and returns
+// it alongside its jti, so that callers can tie it to a refresh token or
+// revoke it later via the jti denylist. mfaVerified should be true only
+// when the signin was completed with a second factor (see webauthn.go).
+// roles is embedded as-is so that RequireRole can check it without another
+// storage round-trip.
+func (j *JwtHmacProvider) CreateStandard(subject string, mfaVerified bool, roles []string) (string, string, error) {
 	now := time.Now()
-	claims := jwt.RegisteredClaims{
-		Issuer:    j.issuer,
-		Subject:   subject,
-		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(j.duration)),
+	jti, err := NewJTI()
+	if err != nil {
+		return "", "", err
+	}
+	claims := AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    j.issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(j.duration)),
+			ID:        jti,
+		},
+		MFAVerified: mfaVerified,
+		Roles:       roles,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(j.hmacSecret)
+	signed, err := token.SignedString(j.hmacSecret)
+	if err != nil {
+		return "", "", err
+	}
+	return signed, jti, nil
 }
 
-func (j *JwtHmacProvider) Verify(tokenString string) (*jwt.RegisteredClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+// CreatePendingMFA issues a short-lived token proving address just
+// produced a verified SIWE signature, without granting it any access:
+// AuthMiddleware refuses any token whose Purpose is set. It exists solely
+// to be presented to LoginBeginHandler/LoginFinishHandler so that
+// completing the WebAuthn ceremony cannot stand in for proving control of
+// the wallet.
+func (j *JwtHmacProvider) CreatePendingMFA(address string) (string, string, error) {
+	now := time.Now()
+	jti, err := NewJTI()
+	if err != nil {
+		return "", "", err
+	}
+	claims := AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    j.issuer,
+			Subject:   address,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(pendingMFATTL)),
+			ID:        jti,
+		},
+		Purpose: pendingMFAPurpose,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(j.hmacSecret)
+	if err != nil {
+		return "", "", err
+	}
+	return signed, jti, nil
+}
+
+func (j *JwtHmacProvider) Verify(tokenString string) (*AccessClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &AccessClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
@@ -68,7 +151,7 @@ func (j *JwtHmacProvider) Verify(tokenString string) (*jwt.RegisteredClaims, err
 	if err != nil {
 		return nil, ErrAuthError
 	}
-	if claims, ok := token.Claims.(*jwt.RegisteredClaims); ok && token.Valid {
+	if claims, ok := token.Claims.(*AccessClaims); ok && token.Valid {
 		return claims, nil
 	}
 	return nil, ErrAuthError
@@ -77,52 +160,17 @@ func (j *JwtHmacProvider) Verify(tokenString string) (*jwt.RegisteredClaims, err
 type User struct {
 	Address string
 	Nonce   string
-}
-
-type MemStorage struct {
-	lock  sync.RWMutex
-	users map[string]User
-}
-
-func (m *MemStorage) CreateIfNotExists(u User) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	if _, exists := m.users[u.Address]; exists {
-		return ErrUserExists
-	}
-	m.users[u.Address] = u
-	return nil
-}
-
-func (m *MemStorage) Get(address string) (User, error) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	u, exists := m.users[address]
-	if !exists {
-		return u, ErrUserNotExists
-	}
-	return u, nil
-}
-
-func (m *MemStorage) Update(user User) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	m.users[user.Address] = user
-	return nil
-}
-
-func NewMemStorage() *MemStorage {
-	ans := MemStorage{
-		users: make(map[string]User),
-	}
-	return &ans
+	// Roles are the role names PolicyStore last granted this address at
+	// signin time. They are refreshed on every signin rather than kept
+	// fully authoritative between signins, so a policy change takes
+	// effect the next time the holder logs in rather than immediately.
+	Roles []string
 }
 
 // ============================================================================
 
 var (
-	hexRegex   *regexp.Regexp = regexp.MustCompile(`^0x[a-fA-F0-9]{40}$`)
-	nonceRegex *regexp.Regexp = regexp.MustCompile(`^[0-9]+$`)
+	hexRegex *regexp.Regexp = regexp.MustCompile(`^0x[a-fA-F0-9]{40}$`)
 )
 
 type RegisterPayload struct {
@@ -136,7 +184,7 @@ func (p RegisterPayload) Validate() error {
 	return nil
 }
 
-func RegisterHandler(storage *MemStorage) http.HandlerFunc {
+func RegisterHandler(storage Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var p RegisterPayload
 		if err := bindReqBody(r, &p); err != nil {
@@ -169,7 +217,7 @@ func RegisterHandler(storage *MemStorage) http.HandlerFunc {
 	}
 }
 
-func UserNonceHandler(storage *MemStorage) http.HandlerFunc {
+func UserNonceHandler(storage Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		address := chi.URLParam(r, "address")
 		if !hexRegex.MatchString(address) {
@@ -195,26 +243,81 @@ func UserNonceHandler(storage *MemStorage) http.HandlerFunc {
 	}
 }
 
+// UserMessageHandler returns the exact EIP-4361 text the wallet must sign
+// with personal_sign in order to authenticate as address.
+func UserMessageHandler(storage Storage, siweConfig SiweConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := chi.URLParam(r, "address")
+		if !hexRegex.MatchString(address) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user, err := storage.Get(strings.ToLower(address))
+		if err != nil {
+			switch errors.Is(err, ErrUserNotExists) {
+			case true:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		// Default to the first configured chain so existing single-chain
+		// callers don't need to change; a caller on a different allowed
+		// chain passes it explicitly so the message it signs actually
+		// matches the chain its wallet is on.
+		chainID := siweConfig.ChainIDs[0]
+		if raw := r.URL.Query().Get("chainId"); raw != "" {
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || !siweConfig.chainAllowed(parsed) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			chainID = parsed
+		}
+		msg := SiweMessage{
+			Domain:    siweConfig.Domain,
+			Address:   common.HexToAddress(user.Address).Hex(),
+			Statement: siweConfig.Statement,
+			URI:       siweConfig.URI,
+			Version:   siweConfig.Version,
+			ChainID:   chainID,
+			Nonce:     user.Nonce,
+			IssuedAt:  time.Now(),
+		}
+		if siweConfig.MessageTTL > 0 {
+			exp := msg.IssuedAt.Add(siweConfig.MessageTTL)
+			msg.ExpirationTime = &exp
+		}
+		resp := struct {
+			Message string `json:"message"`
+		}{
+			Message: msg.Format(),
+		}
+		renderJson(r, w, http.StatusOK, resp)
+	}
+}
+
 type SigninPayload struct {
-	Address string `json:"address"`
-	Nonce   string `json:"nonce"`
-	Sig     string `json:"sig"`
+	Address   string `json:"address"`
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
 }
 
 func (s SigninPayload) Validate() error {
 	if !hexRegex.MatchString(s.Address) {
 		return ErrInvalidAddress
 	}
-	if !nonceRegex.MatchString(s.Nonce) {
-		return ErrInvalidNonce
+	if len(s.Message) == 0 {
+		return ErrInvalidMessage
 	}
-	if len(s.Sig) == 0 {
+	if len(s.Signature) == 0 {
 		return ErrMissingSig
 	}
 	return nil
 }
 
-func SigninHandler(storage *MemStorage, jwtProvider *JwtHmacProvider) http.HandlerFunc {
+func SigninHandler(storage Storage, jwtProvider *JwtHmacProvider, siweConfig SiweConfig, eip1271Config EIP1271Config, policyStore *PolicyStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var p SigninPayload
 		if err := bindReqBody(r, &p); err != nil {
@@ -226,25 +329,66 @@ func SigninHandler(storage *MemStorage, jwtProvider *JwtHmacProvider) http.Handl
 			return
 		}
 		address := strings.ToLower(p.Address)
-		user, err := Authenticate(storage, address, p.Nonce, p.Sig)
+		user, err := Authenticate(r.Context(), storage, siweConfig, eip1271Config, policyStore, address, p.Message, p.Signature)
 		switch err {
 		case nil:
 		case ErrAuthError:
+			signinFailureTotal.WithLabelValues("invalid_signature").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case ErrUserNotExists:
+			signinFailureTotal.WithLabelValues("unregistered_address").Inc()
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		default:
+			signinFailureTotal.WithLabelValues("internal_error").Inc()
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		creds, err := storage.GetWebAuthnCredentials(user.Address)
+		if err != nil {
+			signinFailureTotal.WithLabelValues("internal_error").Inc()
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		signedToken, err := jwtProvider.CreateStandard(user.Address)
+		if len(creds) > 0 {
+			// this account has enrolled a second factor: the wallet
+			// signature alone isn't enough, the client must complete
+			// a WebAuthn assertion via /webauthn/login/{address}/begin
+			// and /finish before it gets an access token. mfaToken proves
+			// to those endpoints that this SIWE signature was already
+			// verified, so the WebAuthn step really is a *second* factor
+			// rather than a standalone credential.
+			mfaToken, _, err := jwtProvider.CreatePendingMFA(user.Address)
+			if err != nil {
+				signinFailureTotal.WithLabelValues("internal_error").Inc()
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			resp := struct {
+				MFARequired bool   `json:"mfaRequired"`
+				MFAToken    string `json:"mfaToken"`
+			}{
+				MFARequired: true,
+				MFAToken:    mfaToken,
+			}
+			renderJson(r, w, http.StatusOK, resp)
+			return
+		}
+
+		accessToken, refreshToken, err := issueTokenPair(storage, jwtProvider, user.Address, "", false, user.Roles)
 		if err != nil {
+			signinFailureTotal.WithLabelValues("internal_error").Inc()
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		signinSuccessTotal.Inc()
 		resp := struct {
-			AccessToken string `json:"access"`
+			AccessToken  string `json:"access"`
+			RefreshToken string `json:"refresh"`
 		}{
-			AccessToken: signedToken,
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
 		}
 		renderJson(r, w, http.StatusOK, resp)
 	}
@@ -270,28 +414,78 @@ func getUserFromReqContext(r *http.Request) User {
 	return key
 }
 
-func AuthMiddleware(storage *MemStorage, jwtProvider *JwtHmacProvider) func(next http.Handler) http.Handler {
+func getJTIFromReqContext(r *http.Request) string {
+	ctx := r.Context()
+	jti, _ := ctx.Value("jti").(string)
+	return jti
+}
+
+func getMFAVerifiedFromReqContext(r *http.Request) bool {
+	ctx := r.Context()
+	verified, _ := ctx.Value("mfaVerified").(bool)
+	return verified
+}
+
+func getRolesFromReqContext(r *http.Request) []string {
+	ctx := r.Context()
+	roles, _ := ctx.Value("roles").([]string)
+	return roles
+}
+
+// bearerToken extracts the raw token string from a "Bearer <token>"
+// Authorization header, reporting false if the header is missing or
+// malformed.
+func bearerToken(r *http.Request) (string, bool) {
+	headerValue := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(headerValue) < len(prefix) {
+		return "", false
+	}
+	tokenString := headerValue[len(prefix):]
+	if len(tokenString) == 0 {
+		return "", false
+	}
+	return tokenString, true
+}
+
+func AuthMiddleware(storage Storage, jwtProvider *JwtHmacProvider) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			headerValue := r.Header.Get("Authorization")
-			const prefix = "Bearer "
-			if len(headerValue) < len(prefix) {
+			tokenString, ok := bearerToken(r)
+			if !ok {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			tokenString := headerValue[len(prefix):]
-			if len(tokenString) == 0 {
+
+			var claims *AccessClaims
+			err := withSpan(r.Context(), "jwtProvider.Verify", func(context.Context) error {
+				var err error
+				claims, err = jwtProvider.Verify(tokenString)
+				return err
+			})
+			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			claims, err := jwtProvider.Verify(tokenString)
-			if err != nil {
+			// Tokens minted for a narrow purpose (see pendingMFAPurpose)
+			// are not valid bearer tokens anywhere else.
+			if claims.Purpose != "" {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			user, err := storage.Get(claims.Subject)
+			if storage.IsJTIRevoked(claims.ID) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var user User
+			err = withSpan(r.Context(), "storage.Get", func(context.Context) error {
+				var err error
+				user, err = storage.Get(claims.Subject)
+				return err
+			})
 			if err != nil {
 				if errors.Is(err, ErrUserNotExists) {
 					w.WriteHeader(http.StatusUnauthorized)
@@ -301,44 +495,129 @@ func AuthMiddleware(storage *MemStorage, jwtProvider *JwtHmacProvider) func(next
 				return
 			}
 
+			if state, ok := r.Context().Value("logState").(*requestLogState); ok {
+				state.address = user.Address
+			}
+
 			ctx := context.WithValue(r.Context(), "user", user)
+			ctx = context.WithValue(ctx, "jti", claims.ID)
+			ctx = context.WithValue(ctx, "mfaVerified", claims.MFAVerified)
+			ctx = context.WithValue(ctx, "roles", claims.Roles)
 			next.ServeHTTP(w, r.WithContext(ctx))
 
 		})
 	}
 }
 
-func Authenticate(storage *MemStorage, address string, nonce string, sigHex string) (User, error) {
-	user, err := storage.Get(address)
+// RequireMFA composes with AuthMiddleware (which must run first) and
+// rejects requests whose access token was not issued after a WebAuthn step
+// up, i.e. SigninHandler found no enrolled credentials for the address.
+func RequireMFA() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !getMFAVerifiedFromReqContext(r) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole composes with AuthMiddleware (which must run first) and
+// rejects requests whose access token doesn't carry at least one of the
+// given roles.
+func RequireRole(roles ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted := getRolesFromReqContext(r)
+			for _, want := range roles {
+				for _, have := range granted {
+					if want == have {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			w.WriteHeader(http.StatusForbidden)
+		})
+	}
+}
+
+func Authenticate(ctx context.Context, storage Storage, siweConfig SiweConfig, eip1271Config EIP1271Config, policyStore *PolicyStore, address string, rawMessage string, sigHex string) (User, error) {
+	ctx, span := tracer.Start(ctx, "Authenticate")
+	defer span.End()
+
+	var user User
+	err := withSpan(ctx, "storage.Get", func(context.Context) error {
+		var err error
+		user, err = storage.Get(address)
+		return err
+	})
 	if err != nil {
 		return user, err
 	}
-	if user.Nonce != nonce {
+
+	siweMsg, err := ParseSiweMessage(rawMessage)
+	if err != nil {
+		return user, ErrAuthError
+	}
+	if err := siweMsg.Validate(siweConfig, user.Address, user.Nonce, time.Now()); err != nil {
 		return user, ErrAuthError
 	}
 
-	sig := hexutil.MustDecode(sigHex)
+	sig, err := hexutil.Decode(sigHex)
+	if err != nil || len(sig) != 65 {
+		return user, ErrAuthError
+	}
+	msg := accounts.TextHash([]byte(rawMessage))
+
+	// try the EOA path first: a personal_sign signature recoverable to
+	// the account's own address via ECDSA.
+	eoaSig := make([]byte, len(sig))
+	copy(eoaSig, sig)
 	// https://github.com/ethereum/go-ethereum/blob/master/internal/ethapi/api.go#L516
 	// check here why I am subtracting 27 from the last byte
-	sig[crypto.RecoveryIDOffset] -= 27
-	msg := accounts.TextHash([]byte(nonce))
-	recovered, err := crypto.SigToPub(msg, sig)
-	if err != nil {
-		return user, err
+	eoaSig[crypto.RecoveryIDOffset] -= 27
+	verified := false
+	if recovered, err := crypto.SigToPub(msg, eoaSig); err == nil {
+		recoveredAddr := crypto.PubkeyToAddress(*recovered)
+		verified = user.Address == strings.ToLower(recoveredAddr.Hex())
+	} else {
+		signatureRecoverErrorsTotal.Inc()
 	}
-	recoveredAddr := crypto.PubkeyToAddress(*recovered)
 
-	if user.Address != strings.ToLower(recoveredAddr.Hex()) {
-		return user, ErrAuthError
+	// ECDSA recovery failing or not matching doesn't mean the signature is
+	// bad: it's also what a smart-contract wallet (Safe, Argent, Ambire,
+	// ERC-4337 accounts, ...) produces, since it never holds a private
+	// key to recover from. Fall back to asking the account itself via
+	// EIP-1271 before giving up.
+	if !verified {
+		var hash [32]byte
+		copy(hash[:], msg)
+		var ok bool
+		err := withSpan(ctx, "verifyEIP1271", func(ctx context.Context) error {
+			var err error
+			ok, err = verifyEIP1271(ctx, eip1271Config, siweMsg.ChainID, common.HexToAddress(user.Address), hash, sig)
+			return err
+		})
+		if err != nil || !ok {
+			return user, ErrAuthError
+		}
 	}
 
 	// update the nonce here so that the signature cannot be resused
-	nonce, err = GetNonce()
+	nonce, err := GetNonce()
 	if err != nil {
 		return user, err
 	}
 	user.Nonce = nonce
-	storage.Update(user)
+	// re-evaluate roles on every signin so a policy change takes effect
+	// the next time this address logs in, without needing a migration.
+	user.Roles = RolesFor(ctx, eip1271Config, policyStore.Document(), user.Address)
+	withSpan(ctx, "storage.Update", func(context.Context) error {
+		return storage.Update(user)
+	})
 
 	return user, nil
 }
@@ -357,6 +636,7 @@ func GetNonce() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	nonceIssuedTotal.Inc()
 	return n.Text(10), nil
 }
 
@@ -383,32 +663,91 @@ func renderJson(r *http.Request, w http.ResponseWriter, statusCode int, res inte
 // ============================================================================
 
 func run() error {
+	slog.SetDefault(NewLogger(os.Getenv("LOG_FORMAT")))
+
+	shutdownTracing, err := InitTracing(os.Getenv("TRACING_EXPORTER"))
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	// initialization of storage
-	storage := NewMemStorage()
+	cfg, err := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return err
+	}
+	storage, err := NewStorage(cfg)
+	if err != nil {
+		return err
+	}
 	jwtProvider := NewJwtHmacProvider(
 		"read something from env here maybe",
 		"awesome-metamask-login",
 		time.Minute*15,
 	)
+	siweConfig := SiweConfig{
+		Domain:     "localhost:8001",
+		URI:        "http://localhost:8001",
+		Statement:  "Sign in with Ethereum to the awesome-metamask-login demo.",
+		Version:    "1",
+		ChainIDs:   []int64{1},
+		MessageTTL: time.Minute * 5,
+	}
+	webauthnService, err := NewWebAuthnService(storage, WebAuthnConfig{
+		RPDisplayName: "awesome-metamask-login",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:8001"},
+	})
+	if err != nil {
+		return err
+	}
+	policyStore, err := NewPolicyStore(cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(policyReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := policyStore.Reload(); err != nil {
+				slog.Error("policy: reload failed", "error", err.Error())
+			}
+		}
+	}()
 
 	// setup the endpoints
 	r := chi.NewRouter()
 
 	//  Just allow all for the reference implementation
 	r.Use(cors.AllowAll().Handler)
+	r.Use(middleware.RequestID)
+	r.Use(RequestLoggingMiddleware)
+	r.Use(MetricsMiddleware)
 
+	r.Get("/metrics", MetricsHandler())
 	r.Post("/register", RegisterHandler(storage))
 	r.Get("/users/{address:^0x[a-fA-F0-9]{40}$}/nonce", UserNonceHandler(storage))
-	r.Post("/signin", SigninHandler(storage, jwtProvider))
+	r.Get("/users/{address:^0x[a-fA-F0-9]{40}$}/message", UserMessageHandler(storage, siweConfig))
+	r.Post("/signin", SigninHandler(storage, jwtProvider, siweConfig, cfg.EIP1271, policyStore))
+	r.Post("/token/refresh", RefreshHandler(storage, jwtProvider))
+	r.Post("/webauthn/login/{address:^0x[a-fA-F0-9]{40}$}/begin", webauthnService.LoginBeginHandler(jwtProvider))
+	r.Post("/webauthn/login/{address:^0x[a-fA-F0-9]{40}$}/finish", webauthnService.LoginFinishHandler(jwtProvider))
 
 	r.Group(func(r chi.Router) {
 		r.Use(AuthMiddleware(storage, jwtProvider))
 		r.Get("/welcome", WelcomeHandler())
+		r.Post("/signout", SignoutHandler(storage))
+		r.Post("/webauthn/register/begin", webauthnService.RegisterBeginHandler())
+		r.Post("/webauthn/register/finish", webauthnService.RegisterFinishHandler())
+
+		r.Group(func(r chi.Router) {
+			r.Use(RequireRole("admin"))
+			r.Get("/admin/policy", PolicyHandler(policyStore))
+		})
 	})
 
 	// start the server on port 8001
-	err := http.ListenAndServe("localhost:8001", r)
-	return err
+	return http.ListenAndServe("localhost:8001", r)
 }
 
 func main() {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// MemStorage is the in-process Storage implementation used by default and
+// in tests. Nothing it holds survives a restart.
+type MemStorage struct {
+	lock  sync.RWMutex
+	users map[string]User
+
+	refreshTokens   map[string]RefreshToken // keyed by HashToken(raw)
+	revokedFamilies map[string]bool
+	revokedJTIs     map[string]bool
+
+	webauthnCreds map[string][]WebAuthnCredential // keyed by address
+}
+
+func NewMemStorage() *MemStorage {
+	ans := MemStorage{
+		users:           make(map[string]User),
+		refreshTokens:   make(map[string]RefreshToken),
+		revokedFamilies: make(map[string]bool),
+		revokedJTIs:     make(map[string]bool),
+		webauthnCreds:   make(map[string][]WebAuthnCredential),
+	}
+	return &ans
+}
+
+func (m *MemStorage) CreateIfNotExists(u User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.users[u.Address]; exists {
+		return ErrUserExists
+	}
+	m.users[u.Address] = u
+	return nil
+}
+
+func (m *MemStorage) Get(address string) (User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	u, exists := m.users[address]
+	if !exists {
+		return u, ErrUserNotExists
+	}
+	return u, nil
+}
+
+func (m *MemStorage) Update(user User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.users[user.Address] = user
+	return nil
+}
+
+func (m *MemStorage) CreateRefreshToken(rt RefreshToken) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refreshTokens[rt.TokenHash] = rt
+	return nil
+}
+
+func (m *MemStorage) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rt, exists := m.refreshTokens[tokenHash]
+	if !exists {
+		return rt, ErrRefreshTokenNotExists
+	}
+	return rt, nil
+}
+
+// MarkRefreshTokenUsed atomically flags a refresh token as spent and
+// reports whether this call was the one that made the transition. Two
+// concurrent callers presenting the same token must not both see
+// transitioned == true: under the lock, only the first sets Used and gets
+// true back, so the caller can tell a genuine first use from a replay.
+func (m *MemStorage) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rt, exists := m.refreshTokens[tokenHash]
+	if !exists {
+		return false, ErrRefreshTokenNotExists
+	}
+	if rt.Used {
+		return false, nil
+	}
+	rt.Used = true
+	m.refreshTokens[tokenHash] = rt
+	return true, nil
+}
+
+// RevokeFamily revokes every refresh token descended from the same initial
+// signin, so that a reused (already-rotated) refresh token burns the whole
+// lineage rather than just itself.
+func (m *MemStorage) RevokeFamily(familyID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.revokedFamilies[familyID] = true
+	return nil
+}
+
+func (m *MemStorage) IsFamilyRevoked(familyID string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.revokedFamilies[familyID]
+}
+
+func (m *MemStorage) RevokeJTI(jti string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.revokedJTIs[jti] = true
+	return nil
+}
+
+func (m *MemStorage) IsJTIRevoked(jti string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.revokedJTIs[jti]
+}
+
+func (m *MemStorage) AddWebAuthnCredential(address string, cred WebAuthnCredential) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.webauthnCreds[address] = append(m.webauthnCreds[address], cred)
+	return nil
+}
+
+func (m *MemStorage) GetWebAuthnCredentials(address string) ([]WebAuthnCredential, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.webauthnCreds[address], nil
+}
+
+func (m *MemStorage) UpdateWebAuthnSignCount(address string, credentialID []byte, signCount uint32) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, cred := range m.webauthnCreds[address] {
+		if bytes.Equal(cred.CredentialID, credentialID) {
+			m.webauthnCreds[address][i].SignCount = signCount
+			return nil
+		}
+	}
+	return ErrWebAuthnCredentialNotExists
+}
+
+var _ Storage = (*MemStorage)(nil)
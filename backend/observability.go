@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total HTTP requests handled, labeled by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency in seconds, labeled by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	signinSuccessTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "signin_success_total",
+		Help: "Total successful /signin attempts.",
+	})
+
+	signinFailureTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "signin_failure_total",
+		Help: "Total failed /signin attempts, labeled by reason.",
+	}, []string{"reason"})
+
+	nonceIssuedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nonce_issued_total",
+		Help: "Total SIWE nonces issued via GetNonce.",
+	})
+
+	signatureRecoverErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "signature_recover_errors_total",
+		Help: "Total personal_sign signatures that failed ECDSA recovery.",
+	})
+)
+
+// tracer is the Tracer every auth code path starts its spans from. It is
+// a no-op until InitTracing installs a real TracerProvider.
+var tracer = otel.Tracer("rest-api-metamask")
+
+// InitTracing installs the OpenTelemetry TracerProvider selected by
+// exporter ("stdout" or "none", default "none") and returns a shutdown
+// func run() should defer. "stdout" is meant for local inspection; a real
+// deployment would add an OTLP exporter here following the same pattern.
+func InitTracing(exporter string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	switch exporter {
+	case "", "none":
+		return noop, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return noop, err
+		}
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+		otel.SetTracerProvider(tp)
+		return tp.Shutdown, nil
+	default:
+		return noop, ErrUnknownTracingExporter
+	}
+}
+
+// withSpan starts a child span named name under ctx, runs fn, records any
+// error fn returns on the span, and ends it. It lets call sites that
+// don't otherwise need direct access to the span (storage calls, JWT
+// verification) get one line of tracing instead of a start/defer pair.
+func withSpan(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+// NewLogger builds the slog.Logger run() installs as the process default,
+// in "json" (default) or "text" format.
+func NewLogger(format string) *slog.Logger {
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+}
+
+// requestLogState is a mutable, pointer-shared holder that lets
+// AuthMiddleware hand the authenticated address back up to
+// RequestLoggingMiddleware. A request's context can only grow new values
+// as it flows downstream (context.WithValue on a *copy*), so there is no
+// way for an outer middleware to read a value an inner one set except
+// through a shared pointer stashed in the context before the chain runs.
+type requestLogState struct {
+	address string
+}
+
+// RequestLoggingMiddleware emits one structured log line per request,
+// with the chi request-id, method, path, status, latency, and (when
+// AuthMiddleware ran and succeeded) the authenticated address.
+func RequestLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		state := &requestLogState{}
+		ctx := context.WithValue(r.Context(), "logState", state)
+		r = r.WithContext(ctx)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		attrs := []slog.Attr{
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", ww.Status()),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if state.address != "" {
+			attrs = append(attrs, slog.String("address", state.address))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "http_request", attrs...)
+	})
+}
+
+// MetricsMiddleware records http_requests_total and
+// http_request_duration_seconds for every request, labeled by the
+// matched chi route pattern rather than the raw path so that path
+// parameters (addresses, token hashes, ...) don't blow up label
+// cardinality.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		httpRequestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(ww.Status())).Inc()
+		httpRequestDurationSeconds.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// MetricsHandler serves the /metrics endpoint promhttp scrapes.
+func MetricsHandler() http.HandlerFunc {
+	return promhttp.Handler().ServeHTTP
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// policyReloadInterval is how often run() polls PolicyFile for changes.
+const policyReloadInterval = 30 * time.Second
+
+// PolicyRule grants Role to any address that matches it, either directly
+// (Addresses) or by holding at least MinBalance of an ERC-20/ERC-721 token
+// (TokenContract/ChainID), per request shaddylangton/trial#chunk0-6.
+type PolicyRule struct {
+	Role      string   `yaml:"role" json:"role"`
+	Addresses []string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+
+	TokenContract string `yaml:"token_contract,omitempty" json:"token_contract,omitempty"`
+	ChainID       int64  `yaml:"chain_id,omitempty" json:"chain_id,omitempty"`
+	// MinBalance is a base-10 integer string (so it can hold amounts
+	// beyond what a JSON/YAML number can represent exactly).
+	MinBalance string `yaml:"min_balance,omitempty" json:"min_balance,omitempty"`
+}
+
+func (r PolicyRule) grantsByAddress(address string) bool {
+	for _, a := range r.Addresses {
+		if strings.ToLower(a) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// grantsByBalance reports whether address's balanceOf(address) on
+// r.TokenContract meets r.MinBalance, per ERC-20/ERC-721's shared
+// balanceOf(address) returns (uint256) signature.
+func (r PolicyRule) grantsByBalance(ctx context.Context, cfg EIP1271Config, address string) (bool, error) {
+	minBalance, ok := new(big.Int).SetString(r.MinBalance, 10)
+	if !ok {
+		return false, fmt.Errorf("policy: rule %q: invalid min_balance %q", r.Role, r.MinBalance)
+	}
+
+	addressType, err := abi.NewType("address", "", nil)
+	if err != nil {
+		return false, err
+	}
+	args := abi.Arguments{{Type: addressType}}
+	packed, err := args.Pack(common.HexToAddress(address))
+	if err != nil {
+		return false, err
+	}
+	selector := crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+
+	out, err := ethCall(ctx, cfg, r.ChainID, common.HexToAddress(r.TokenContract), append(selector, packed...))
+	if err != nil {
+		return false, err
+	}
+	return new(big.Int).SetBytes(out).Cmp(minBalance) >= 0, nil
+}
+
+// PolicyDocument is the on-disk shape of a policy file: a flat list of
+// rules, evaluated independently and unioned together.
+type PolicyDocument struct {
+	Rules []PolicyRule `yaml:"rules" json:"rules"`
+}
+
+// RolesFor evaluates every rule in doc against address and returns the
+// (deduplicated) set of roles it is granted. A rule that fails its
+// on-chain lookup (RPC down, unconfigured chain, ...) is skipped rather
+// than treated as an error, so a flaky RPC endpoint degrades one rule
+// instead of signin as a whole.
+func RolesFor(ctx context.Context, eip1271Config EIP1271Config, doc PolicyDocument, address string) []string {
+	address = strings.ToLower(address)
+
+	seen := make(map[string]bool)
+	var roles []string
+	grant := func(role string) {
+		if role == "" || seen[role] {
+			return
+		}
+		seen[role] = true
+		roles = append(roles, role)
+	}
+
+	for _, rule := range doc.Rules {
+		if rule.grantsByAddress(address) {
+			grant(rule.Role)
+			continue
+		}
+		if rule.TokenContract != "" {
+			if ok, err := rule.grantsByBalance(ctx, eip1271Config, address); err == nil && ok {
+				grant(rule.Role)
+			}
+		}
+	}
+	return roles
+}
+
+// PolicyStore holds the currently loaded PolicyDocument and knows how to
+// hot-reload it from disk. Reload is cheap to call on a poll: it
+// fingerprints the file's content and only swaps the parsed document in
+// when that fingerprint actually changes, so operators can edit the
+// policy file and have it picked up without restarting the server.
+type PolicyStore struct {
+	path string
+
+	mu          sync.RWMutex
+	fingerprint string
+	doc         PolicyDocument
+}
+
+// NewPolicyStore creates a PolicyStore backed by the YAML or JSON file at
+// path (selected by its ".json" extension, YAML otherwise). path may be
+// empty, or may not exist yet, in which case the store starts out with an
+// empty PolicyDocument and Reload will pick the file up once it appears.
+func NewPolicyStore(path string) (*PolicyStore, error) {
+	s := &PolicyStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the policy file if its content has changed since the
+// last successful load, and is safe to call concurrently with Document.
+// A missing file is not an error: the store just keeps whatever document
+// it last loaded (or the empty one, if it never has).
+func (s *PolicyStore) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	s.mu.RLock()
+	unchanged := fingerprint == s.fingerprint
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var doc PolicyDocument
+	if strings.HasSuffix(s.path, ".json") {
+		err = json.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return fmt.Errorf("policy: parse %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.doc = doc
+	s.fingerprint = fingerprint
+	s.mu.Unlock()
+	return nil
+}
+
+// Document returns the currently loaded policy.
+func (s *PolicyStore) Document() PolicyDocument {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.doc
+}
+
+// PolicyHandler exposes the currently loaded policy document, for
+// operators to confirm what's live without reading the file off the
+// server's disk directly. It sits behind RequireRole("admin").
+func PolicyHandler(policyStore *PolicyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderJson(r, w, http.StatusOK, policyStore.Document())
+	}
+}
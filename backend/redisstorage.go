@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStorage is a Storage implementation backed by Redis. It trades the
+// durability of SQLStorage for horizontal scalability and Redis's native
+// key expiry, which the SQL backend has to emulate with extra columns.
+type RedisStorage struct {
+	client *redis.Client
+	// revocationTTL bounds how long a revoked family/jti entry is kept
+	// around; it should be set to at least the access-token and
+	// refresh-token lifetimes so a revocation can never expire out from
+	// under a still-valid token.
+	revocationTTL time.Duration
+}
+
+func NewRedisStorage(client *redis.Client, revocationTTL time.Duration) *RedisStorage {
+	return &RedisStorage{client: client, revocationTTL: revocationTTL}
+}
+
+func redisOpen(cfg RedisConfig) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+}
+
+func userKey(address string) string           { return "user:" + address }
+func refreshTokenKey(tokenHash string) string { return "refresh:" + tokenHash }
+func refreshUsedKey(tokenHash string) string  { return "refreshused:" + tokenHash }
+func revokedFamilyKey(familyID string) string { return "revokedfamily:" + familyID }
+func revokedJTIKey(jti string) string         { return "revokedjti:" + jti }
+func webauthnCredsKey(address string) string  { return "webauthncreds:" + address }
+
+func (s *RedisStorage) CreateIfNotExists(u User) error {
+	ctx := context.Background()
+	encoded, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	ok, err := s.client.SetNX(ctx, userKey(u.Address), encoded, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (s *RedisStorage) Get(address string) (User, error) {
+	var u User
+	ctx := context.Background()
+	encoded, err := s.client.Get(ctx, userKey(address)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return u, ErrUserNotExists
+		}
+		return u, err
+	}
+	if err := json.Unmarshal(encoded, &u); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+func (s *RedisStorage) Update(user User) error {
+	ctx := context.Background()
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, userKey(user.Address), encoded, 0).Err()
+}
+
+func (s *RedisStorage) CreateRefreshToken(rt RefreshToken) error {
+	ctx := context.Background()
+	encoded, err := json.Marshal(rt)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(rt.ExpiresAt)
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	return s.client.Set(ctx, refreshTokenKey(rt.TokenHash), encoded, ttl).Err()
+}
+
+func (s *RedisStorage) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	var rt RefreshToken
+	ctx := context.Background()
+	encoded, err := s.client.Get(ctx, refreshTokenKey(tokenHash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return rt, ErrRefreshTokenNotExists
+		}
+		return rt, err
+	}
+	if err := json.Unmarshal(encoded, &rt); err != nil {
+		return rt, err
+	}
+	return rt, nil
+}
+
+// MarkRefreshTokenUsed atomically flags a refresh token as spent and
+// reports whether this call was the one that made the transition. The
+// compare-and-swap is the SetNX on the separate refreshUsedKey marker:
+// Redis only lets one of two racing SetNX calls for the same key succeed,
+// so only one caller redeeming the same token ever gets transitioned ==
+// true back, no matter how the JSON record itself is read or written.
+func (s *RedisStorage) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	ctx := context.Background()
+	key := refreshTokenKey(tokenHash)
+	rt, err := s.GetRefreshToken(tokenHash)
+	if err != nil {
+		return false, err
+	}
+	ttl, err := s.client.TTL(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	transitioned, err := s.client.SetNX(ctx, refreshUsedKey(tokenHash), "1", ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	if !transitioned {
+		return false, nil
+	}
+
+	rt.Used = true
+	encoded, err := json.Marshal(rt)
+	if err != nil {
+		return true, err
+	}
+	if err := s.client.Set(ctx, key, encoded, ttl).Err(); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (s *RedisStorage) RevokeFamily(familyID string) error {
+	ctx := context.Background()
+	return s.client.Set(ctx, revokedFamilyKey(familyID), "1", s.revocationTTL).Err()
+}
+
+func (s *RedisStorage) IsFamilyRevoked(familyID string) bool {
+	ctx := context.Background()
+	n, err := s.client.Exists(ctx, revokedFamilyKey(familyID)).Result()
+	return err == nil && n > 0
+}
+
+func (s *RedisStorage) RevokeJTI(jti string) error {
+	ctx := context.Background()
+	return s.client.Set(ctx, revokedJTIKey(jti), "1", s.revocationTTL).Err()
+}
+
+func (s *RedisStorage) IsJTIRevoked(jti string) bool {
+	ctx := context.Background()
+	n, err := s.client.Exists(ctx, revokedJTIKey(jti)).Result()
+	return err == nil && n > 0
+}
+
+// webauthnCredsTxRetries bounds how many attempts transactWebAuthnCredentials
+// makes in total (the first try included) while losing the
+// optimistic-locking race on webauthnCredsKey, e.g. two devices enrolling
+// for the same address at once.
+const webauthnCredsTxRetries = 10
+
+// transactWebAuthnCredentials read-modifies-writes the credential list for
+// address under a WATCH on its key, so a concurrent writer touching the
+// same list can't have its update silently clobbered: mutate is called
+// with the list as most recently observed, and if another client changed
+// the key before our write commits, we're told via redis.TxFailedErr and
+// retry against the fresh value instead of overwriting it.
+func (s *RedisStorage) transactWebAuthnCredentials(address string, mutate func(creds []WebAuthnCredential) ([]WebAuthnCredential, error)) error {
+	ctx := context.Background()
+	key := webauthnCredsKey(address)
+	for attempt := 0; attempt < webauthnCredsTxRetries; attempt++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			creds, err := redisGetWebAuthnCredentials(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			creds, err = mutate(creds)
+			if err != nil {
+				return err
+			}
+			encoded, err := json.Marshal(creds)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, encoded, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("redisstorage: too much contention on %s", key)
+}
+
+func redisGetWebAuthnCredentials(ctx context.Context, cmdable redis.Cmdable, key string) ([]WebAuthnCredential, error) {
+	encoded, err := cmdable.Get(ctx, key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var creds []WebAuthnCredential
+	if err := json.Unmarshal(encoded, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (s *RedisStorage) AddWebAuthnCredential(address string, cred WebAuthnCredential) error {
+	return s.transactWebAuthnCredentials(address, func(creds []WebAuthnCredential) ([]WebAuthnCredential, error) {
+		return append(creds, cred), nil
+	})
+}
+
+func (s *RedisStorage) GetWebAuthnCredentials(address string) ([]WebAuthnCredential, error) {
+	return redisGetWebAuthnCredentials(context.Background(), s.client, webauthnCredsKey(address))
+}
+
+func (s *RedisStorage) UpdateWebAuthnSignCount(address string, credentialID []byte, signCount uint32) error {
+	return s.transactWebAuthnCredentials(address, func(creds []WebAuthnCredential) ([]WebAuthnCredential, error) {
+		for i, cred := range creds {
+			if bytes.Equal(cred.CredentialID, credentialID) {
+				creds[i].SignCount = signCount
+				return creds, nil
+			}
+		}
+		return nil, ErrWebAuthnCredentialNotExists
+	})
+}
+
+var _ Storage = (*RedisStorage)(nil)
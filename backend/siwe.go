@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidMessage     = errors.New("invalid siwe message")
+	ErrDomainMismatch     = errors.New("domain mismatch")
+	ErrChainNotAllowed    = errors.New("chain id not allowed")
+	ErrMessageExpired     = errors.New("message expired")
+	ErrMessageNotYetValid = errors.New("message not yet valid")
+)
+
+// SiweConfig holds the server-side parameters used to build and validate
+// EIP-4361 Sign-In with Ethereum messages.
+type SiweConfig struct {
+	Domain     string
+	URI        string
+	Statement  string
+	Version    string
+	ChainIDs   []int64
+	MessageTTL time.Duration
+}
+
+func (c SiweConfig) chainAllowed(chainID int64) bool {
+	for _, id := range c.ChainIDs {
+		if id == chainID {
+			return true
+		}
+	}
+	return false
+}
+
+// SiweMessage is the structured form of an EIP-4361 message.
+type SiweMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// Format renders the message into the exact text the wallet must sign with
+// personal_sign.
+func (m SiweMessage) Format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s wants you to sign in with your Ethereum account:\n", m.Domain)
+	fmt.Fprintf(&b, "%s\n\n", m.Address)
+	if m.Statement != "" {
+		fmt.Fprintf(&b, "%s\n", m.Statement)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "URI: %s\n", m.URI)
+	fmt.Fprintf(&b, "Version: %s\n", m.Version)
+	fmt.Fprintf(&b, "Chain ID: %d\n", m.ChainID)
+	fmt.Fprintf(&b, "Nonce: %s\n", m.Nonce)
+	fmt.Fprintf(&b, "Issued At: %s", m.IssuedAt.UTC().Format(time.RFC3339))
+	if m.ExpirationTime != nil {
+		fmt.Fprintf(&b, "\nExpiration Time: %s", m.ExpirationTime.UTC().Format(time.RFC3339))
+	}
+	if m.NotBefore != nil {
+		fmt.Fprintf(&b, "\nNot Before: %s", m.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if m.RequestID != "" {
+		fmt.Fprintf(&b, "\nRequest ID: %s", m.RequestID)
+	}
+	if len(m.Resources) > 0 {
+		b.WriteString("\nResources:")
+		for _, res := range m.Resources {
+			fmt.Fprintf(&b, "\n- %s", res)
+		}
+	}
+	return b.String()
+}
+
+// ParseSiweMessage parses the line-oriented text produced by Format back
+// into a SiweMessage. It is intentionally self-contained rather than a
+// full grammar so that the server only has to understand what it itself
+// produced.
+func ParseSiweMessage(raw string) (*SiweMessage, error) {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	if len(lines) < 9 {
+		return nil, ErrInvalidMessage
+	}
+
+	const preambleSuffix = " wants you to sign in with your Ethereum account:"
+	if !strings.HasSuffix(lines[0], preambleSuffix) {
+		return nil, ErrInvalidMessage
+	}
+	msg := &SiweMessage{
+		Domain:  strings.TrimSuffix(lines[0], preambleSuffix),
+		Address: lines[1],
+	}
+	if lines[2] != "" {
+		return nil, ErrInvalidMessage
+	}
+
+	idx := 3
+	var statement []string
+	for idx < len(lines) && lines[idx] != "" {
+		statement = append(statement, lines[idx])
+		idx++
+	}
+	msg.Statement = strings.Join(statement, "\n")
+	idx++ // skip blank line separating statement from the fields block
+
+	for idx < len(lines) {
+		line := lines[idx]
+		switch {
+		case strings.HasPrefix(line, "URI: "):
+			msg.URI = strings.TrimPrefix(line, "URI: ")
+		case strings.HasPrefix(line, "Version: "):
+			msg.Version = strings.TrimPrefix(line, "Version: ")
+		case strings.HasPrefix(line, "Chain ID: "):
+			chainID, err := strconv.ParseInt(strings.TrimPrefix(line, "Chain ID: "), 10, 64)
+			if err != nil {
+				return nil, ErrInvalidMessage
+			}
+			msg.ChainID = chainID
+		case strings.HasPrefix(line, "Nonce: "):
+			msg.Nonce = strings.TrimPrefix(line, "Nonce: ")
+		case strings.HasPrefix(line, "Issued At: "):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, "Issued At: "))
+			if err != nil {
+				return nil, ErrInvalidMessage
+			}
+			msg.IssuedAt = t
+		case strings.HasPrefix(line, "Expiration Time: "):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, "Expiration Time: "))
+			if err != nil {
+				return nil, ErrInvalidMessage
+			}
+			msg.ExpirationTime = &t
+		case strings.HasPrefix(line, "Not Before: "):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, "Not Before: "))
+			if err != nil {
+				return nil, ErrInvalidMessage
+			}
+			msg.NotBefore = &t
+		case strings.HasPrefix(line, "Request ID: "):
+			msg.RequestID = strings.TrimPrefix(line, "Request ID: ")
+		case line == "Resources:":
+			for idx+1 < len(lines) && strings.HasPrefix(lines[idx+1], "- ") {
+				idx++
+				msg.Resources = append(msg.Resources, strings.TrimPrefix(lines[idx], "- "))
+			}
+		default:
+			return nil, ErrInvalidMessage
+		}
+		idx++
+	}
+
+	if msg.URI == "" || msg.Version == "" || msg.Nonce == "" || msg.IssuedAt.IsZero() {
+		return nil, ErrInvalidMessage
+	}
+	return msg, nil
+}
+
+// Validate checks the message's domain, address, nonce, chain id and
+// not-before/expiration window against the server's SIWE configuration and
+// the nonce/address it expects for this signin attempt. URI, version,
+// statement, issued-at, request id and resources are not checked, and
+// neither is the signature itself.
+func (m SiweMessage) Validate(cfg SiweConfig, address string, nonce string, now time.Time) error {
+	if !strings.EqualFold(m.Domain, cfg.Domain) {
+		return ErrDomainMismatch
+	}
+	if !strings.EqualFold(m.Address, address) {
+		return ErrInvalidAddress
+	}
+	if m.Nonce != nonce {
+		return ErrInvalidNonce
+	}
+	if !cfg.chainAllowed(m.ChainID) {
+		return ErrChainNotAllowed
+	}
+	if m.NotBefore != nil && now.Before(*m.NotBefore) {
+		return ErrMessageNotYetValid
+	}
+	if m.ExpirationTime != nil && now.After(*m.ExpirationTime) {
+		return ErrMessageExpired
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// encodeCredentialID/decodeCredentialID hex-encode the opaque byte blobs
+// WebAuthn deals in (credential ids, AAGUIDs) so they can live in a TEXT
+// primary key/column across both SQL backends.
+func encodeCredentialID(b []byte) string { return hex.EncodeToString(b) }
+
+func decodeCredentialID(s string) ([]byte, error) { return hex.DecodeString(s) }
+
+// sqlOpen opens a *sql.DB for cfg.Driver/cfg.DSN and tunes its connection
+// pool. It does not run migrations; callers that need the schema created
+// should call SQLStorage.Migrate afterwards.
+func sqlOpen(cfg SQLConfig) (*sql.DB, error) {
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+	return db, nil
+}
+
+// SQLStorage is a Storage implementation backed by database/sql. It
+// supports Postgres (driver "postgres", via github.com/lib/pq) and SQLite
+// (driver "sqlite", via modernc.org/sqlite); both speak plain SQL with no
+// backend-specific features beyond ON CONFLICT, the placeholder syntax
+// (see rebind) and the binary column type (see Migrate).
+type SQLStorage struct {
+	db     *sql.DB
+	driver string
+}
+
+// NewSQLStorage wraps an already-open *sql.DB. Callers are expected to have
+// configured the pool (SetMaxOpenConns etc, see Config.SQL) before or after
+// calling this; NewSQLStorage does not change pool settings itself.
+func NewSQLStorage(db *sql.DB, driver string) *SQLStorage {
+	return &SQLStorage{db: db, driver: driver}
+}
+
+// Migrate creates the tables SQLStorage needs if they do not already exist.
+func (s *SQLStorage) Migrate() error {
+	// Postgres has no BLOB type; BYTEA is its binary column type.
+	blobType := "BLOB"
+	if s.driver == "postgres" {
+		blobType = "BYTEA"
+	}
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			address TEXT PRIMARY KEY,
+			nonce   TEXT NOT NULL,
+			roles   TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash   TEXT PRIMARY KEY,
+			address      TEXT NOT NULL,
+			jti          TEXT NOT NULL,
+			parent_jti   TEXT NOT NULL,
+			family_id    TEXT NOT NULL,
+			mfa_verified BOOLEAN NOT NULL,
+			roles        TEXT NOT NULL,
+			issued_at    INTEGER NOT NULL,
+			expires_at   INTEGER NOT NULL,
+			used         BOOLEAN NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_families (
+			family_id TEXT PRIMARY KEY
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_jtis (
+			jti TEXT PRIMARY KEY
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			address          TEXT NOT NULL,
+			credential_id    TEXT PRIMARY KEY,
+			public_key       ` + blobType + ` NOT NULL,
+			attestation_type TEXT NOT NULL,
+			transports       TEXT NOT NULL,
+			aaguid           TEXT NOT NULL,
+			sign_count       INTEGER NOT NULL,
+			clone_warning    BOOLEAN NOT NULL
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("sqlstorage: migrate: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites a query written with "?" placeholders into the syntax
+// the configured driver expects (Postgres wants $1, $2, ...).
+func (s *SQLStorage) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLStorage) CreateIfNotExists(u User) error {
+	res, err := s.db.Exec(s.rebind(
+		`INSERT INTO users (address, nonce, roles) VALUES (?, ?, ?) ON CONFLICT (address) DO NOTHING`,
+	), u.Address, u.Nonce, strings.Join(u.Roles, ","))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (s *SQLStorage) Get(address string) (User, error) {
+	var u User
+	var roles string
+	row := s.db.QueryRow(s.rebind(`SELECT address, nonce, roles FROM users WHERE address = ?`), address)
+	if err := row.Scan(&u.Address, &u.Nonce, &roles); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return u, ErrUserNotExists
+		}
+		return u, err
+	}
+	if roles != "" {
+		u.Roles = strings.Split(roles, ",")
+	}
+	return u, nil
+}
+
+func (s *SQLStorage) Update(user User) error {
+	_, err := s.db.Exec(s.rebind(
+		`UPDATE users SET nonce = ?, roles = ? WHERE address = ?`,
+	), user.Nonce, strings.Join(user.Roles, ","), user.Address)
+	return err
+}
+
+func (s *SQLStorage) CreateRefreshToken(rt RefreshToken) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO refresh_tokens (token_hash, address, jti, parent_jti, family_id, mfa_verified, roles, issued_at, expires_at, used)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`), rt.TokenHash, rt.Address, rt.JTI, rt.ParentJTI, rt.FamilyID, rt.MFAVerified, strings.Join(rt.Roles, ","), rt.IssuedAt.Unix(), rt.ExpiresAt.Unix(), rt.Used)
+	return err
+}
+
+func (s *SQLStorage) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	var rt RefreshToken
+	var issuedAt, expiresAt int64
+	var roles string
+	row := s.db.QueryRow(s.rebind(`
+		SELECT token_hash, address, jti, parent_jti, family_id, mfa_verified, roles, issued_at, expires_at, used
+		FROM refresh_tokens WHERE token_hash = ?
+	`), tokenHash)
+	if err := row.Scan(&rt.TokenHash, &rt.Address, &rt.JTI, &rt.ParentJTI, &rt.FamilyID, &rt.MFAVerified, &roles, &issuedAt, &expiresAt, &rt.Used); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return rt, ErrRefreshTokenNotExists
+		}
+		return rt, err
+	}
+	if roles != "" {
+		rt.Roles = strings.Split(roles, ",")
+	}
+	rt.IssuedAt = time.Unix(issuedAt, 0)
+	rt.ExpiresAt = time.Unix(expiresAt, 0)
+	return rt, nil
+}
+
+// MarkRefreshTokenUsed atomically flags a refresh token as spent and
+// reports whether this call was the one that made the transition. The
+// "AND used = false" makes the UPDATE a compare-and-swap: if two requests
+// race to redeem the same token, the database's row lock lets only one of
+// them affect a row, so only one gets transitioned == true back.
+func (s *SQLStorage) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	res, err := s.db.Exec(s.rebind(`UPDATE refresh_tokens SET used = ? WHERE token_hash = ? AND used = ?`), true, tokenHash, false)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+	// The UPDATE affected no row either because the token doesn't exist or
+	// because it was already used; tell those apart so a caller that
+	// hasn't already confirmed existence still gets ErrRefreshTokenNotExists.
+	var discard string
+	row := s.db.QueryRow(s.rebind(`SELECT token_hash FROM refresh_tokens WHERE token_hash = ?`), tokenHash)
+	if err := row.Scan(&discard); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrRefreshTokenNotExists
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *SQLStorage) RevokeFamily(familyID string) error {
+	_, err := s.db.Exec(s.rebind(
+		`INSERT INTO revoked_families (family_id) VALUES (?) ON CONFLICT (family_id) DO NOTHING`,
+	), familyID)
+	return err
+}
+
+func (s *SQLStorage) IsFamilyRevoked(familyID string) bool {
+	var discard string
+	row := s.db.QueryRow(s.rebind(`SELECT family_id FROM revoked_families WHERE family_id = ?`), familyID)
+	return row.Scan(&discard) == nil
+}
+
+func (s *SQLStorage) RevokeJTI(jti string) error {
+	_, err := s.db.Exec(s.rebind(
+		`INSERT INTO revoked_jtis (jti) VALUES (?) ON CONFLICT (jti) DO NOTHING`,
+	), jti)
+	return err
+}
+
+func (s *SQLStorage) IsJTIRevoked(jti string) bool {
+	var discard string
+	row := s.db.QueryRow(s.rebind(`SELECT jti FROM revoked_jtis WHERE jti = ?`), jti)
+	return row.Scan(&discard) == nil
+}
+
+func (s *SQLStorage) AddWebAuthnCredential(address string, cred WebAuthnCredential) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO webauthn_credentials (address, credential_id, public_key, attestation_type, transports, aaguid, sign_count, clone_warning)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`), address, encodeCredentialID(cred.CredentialID), cred.PublicKey, cred.AttestationType,
+		strings.Join(cred.Transports, ","), encodeCredentialID(cred.AAGUID), cred.SignCount, cred.CloneWarning)
+	return err
+}
+
+func (s *SQLStorage) GetWebAuthnCredentials(address string) ([]WebAuthnCredential, error) {
+	rows, err := s.db.Query(s.rebind(`
+		SELECT credential_id, public_key, attestation_type, transports, aaguid, sign_count, clone_warning
+		FROM webauthn_credentials WHERE address = ?
+	`), address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []WebAuthnCredential
+	for rows.Next() {
+		var cred WebAuthnCredential
+		var credentialID, aaguid, transports string
+		if err := rows.Scan(&credentialID, &cred.PublicKey, &cred.AttestationType, &transports, &aaguid, &cred.SignCount, &cred.CloneWarning); err != nil {
+			return nil, err
+		}
+		cred.CredentialID, err = decodeCredentialID(credentialID)
+		if err != nil {
+			return nil, err
+		}
+		cred.AAGUID, err = decodeCredentialID(aaguid)
+		if err != nil {
+			return nil, err
+		}
+		if transports != "" {
+			cred.Transports = strings.Split(transports, ",")
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+func (s *SQLStorage) UpdateWebAuthnSignCount(address string, credentialID []byte, signCount uint32) error {
+	res, err := s.db.Exec(s.rebind(
+		`UPDATE webauthn_credentials SET sign_count = ? WHERE address = ? AND credential_id = ?`,
+	), signCount, address, encodeCredentialID(credentialID))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebAuthnCredentialNotExists
+	}
+	return nil
+}
+
+var _ Storage = (*SQLStorage)(nil)
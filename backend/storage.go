@@ -0,0 +1,31 @@
+package main
+
+// Storage is the persistence boundary for everything the auth server needs
+// to remember: users (and their current SIWE nonce), refresh tokens and
+// their rotation lineage, and revocation lists for refresh-token families
+// and access-token jtis. MemStorage, SQLStorage and RedisStorage all
+// implement it; run() picks one based on Config.
+type Storage interface {
+	CreateIfNotExists(u User) error
+	Get(address string) (User, error)
+	Update(user User) error
+
+	CreateRefreshToken(rt RefreshToken) error
+	GetRefreshToken(tokenHash string) (RefreshToken, error)
+	// MarkRefreshTokenUsed atomically flags a refresh token as spent and
+	// reports whether this call made the transition, so a caller can tell
+	// a genuine first use from two requests racing to redeem the same
+	// token (the second sees transitioned == false and must treat it as
+	// reuse of an already-used token).
+	MarkRefreshTokenUsed(tokenHash string) (transitioned bool, err error)
+
+	RevokeFamily(familyID string) error
+	IsFamilyRevoked(familyID string) bool
+
+	RevokeJTI(jti string) error
+	IsJTIRevoked(jti string) bool
+
+	AddWebAuthnCredential(address string, cred WebAuthnCredential) error
+	GetWebAuthnCredentials(address string) ([]WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(address string, credentialID []byte, signCount uint32) error
+}
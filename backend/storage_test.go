@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// runStorageConformanceTests exercises the full Storage contract against
+// newStorage(). Every backend is expected to pass this unchanged.
+func runStorageConformanceTests(t *testing.T, newStorage func() Storage) {
+	t.Run("CreateIfNotExists rejects duplicates", func(t *testing.T) {
+		s := newStorage()
+		u := User{Address: "0xabc", Nonce: "1"}
+		if err := s.CreateIfNotExists(u); err != nil {
+			t.Fatalf("first create: %v", err)
+		}
+		if err := s.CreateIfNotExists(u); !errors.Is(err, ErrUserExists) {
+			t.Fatalf("expected ErrUserExists, got %v", err)
+		}
+	})
+
+	t.Run("Get returns ErrUserNotExists for unknown address", func(t *testing.T) {
+		s := newStorage()
+		if _, err := s.Get("0xdoesnotexist"); !errors.Is(err, ErrUserNotExists) {
+			t.Fatalf("expected ErrUserNotExists, got %v", err)
+		}
+	})
+
+	t.Run("Update persists the new nonce", func(t *testing.T) {
+		s := newStorage()
+		u := User{Address: "0xabc", Nonce: "1"}
+		if err := s.CreateIfNotExists(u); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		u.Nonce = "2"
+		if err := s.Update(u); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		got, err := s.Get(u.Address)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got.Nonce != "2" {
+			t.Fatalf("expected nonce 2, got %s", got.Nonce)
+		}
+	})
+
+	t.Run("refresh token lifecycle", func(t *testing.T) {
+		s := newStorage()
+		rt := RefreshToken{
+			TokenHash: "hash-1",
+			Address:   "0xabc",
+			JTI:       "jti-1",
+			FamilyID:  "family-1",
+			IssuedAt:  time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		if err := s.CreateRefreshToken(rt); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		got, err := s.GetRefreshToken(rt.TokenHash)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got.Used {
+			t.Fatalf("expected fresh refresh token to be unused")
+		}
+		transitioned, err := s.MarkRefreshTokenUsed(rt.TokenHash)
+		if err != nil {
+			t.Fatalf("mark used: %v", err)
+		}
+		if !transitioned {
+			t.Fatalf("expected first MarkRefreshTokenUsed to transition the token")
+		}
+		got, err = s.GetRefreshToken(rt.TokenHash)
+		if err != nil {
+			t.Fatalf("get after use: %v", err)
+		}
+		if !got.Used {
+			t.Fatalf("expected refresh token to be marked used")
+		}
+		if transitioned, err := s.MarkRefreshTokenUsed(rt.TokenHash); err != nil || transitioned {
+			t.Fatalf("expected replayed MarkRefreshTokenUsed to report transitioned=false, got (%v, %v)", transitioned, err)
+		}
+		if _, err := s.MarkRefreshTokenUsed("missing-hash"); !errors.Is(err, ErrRefreshTokenNotExists) {
+			t.Fatalf("expected ErrRefreshTokenNotExists, got %v", err)
+		}
+	})
+
+	t.Run("family and jti revocation", func(t *testing.T) {
+		s := newStorage()
+		if s.IsFamilyRevoked("family-1") {
+			t.Fatalf("family should not start revoked")
+		}
+		if err := s.RevokeFamily("family-1"); err != nil {
+			t.Fatalf("revoke family: %v", err)
+		}
+		if !s.IsFamilyRevoked("family-1") {
+			t.Fatalf("family should be revoked")
+		}
+
+		if s.IsJTIRevoked("jti-1") {
+			t.Fatalf("jti should not start revoked")
+		}
+		if err := s.RevokeJTI("jti-1"); err != nil {
+			t.Fatalf("revoke jti: %v", err)
+		}
+		if !s.IsJTIRevoked("jti-1") {
+			t.Fatalf("jti should be revoked")
+		}
+	})
+}
+
+func TestMemStorageConformance(t *testing.T) {
+	runStorageConformanceTests(t, func() Storage {
+		return NewMemStorage()
+	})
+}
+
+func TestSQLStorageConformance(t *testing.T) {
+	runStorageConformanceTests(t, func() Storage {
+		db, err := sql.Open("sqlite", ":memory:")
+		if err != nil {
+			t.Fatalf("open sqlite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		// a single shared connection keeps the in-memory database alive
+		// for the lifetime of the test instead of each pooled connection
+		// getting its own throwaway database.
+		db.SetMaxOpenConns(1)
+		storage := NewSQLStorage(db, "sqlite")
+		if err := storage.Migrate(); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		return storage
+	})
+}
+
+// TestRedisStorageConformance only runs against a real Redis instance,
+// pointed to by AUTH_TEST_REDIS_ADDR, since Redis has no in-process mode.
+func TestRedisStorageConformance(t *testing.T) {
+	addr := os.Getenv("AUTH_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("AUTH_TEST_REDIS_ADDR not set, skipping Redis-backed conformance test")
+	}
+	runStorageConformanceTests(t, func() Storage {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		t.Cleanup(func() {
+			client.FlushDB(context.Background())
+			client.Close()
+		})
+		return NewRedisStorage(client, time.Hour)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RefreshToken is the server-side record for an opaque refresh token. Only
+// its hash is ever persisted; the raw value is handed to the client once,
+// at issuance time, and never stored.
+type RefreshToken struct {
+	TokenHash   string
+	Address     string
+	JTI         string   // identifies this refresh token, independent of any access token's jti
+	ParentJTI   string   // jti of the refresh token it was rotated from, "" for the first in a family
+	FamilyID    string   // stable across an entire rotation lineage, used to revoke-on-reuse
+	MFAVerified bool     // carried over from the signin that started this family, so rotation can't drop a completed MFA step-up
+	Roles       []string // carried over from the signin that started this family, so rotation doesn't silently drop roles granted at that signin
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+	Used        bool
+}
+
+// refreshTokenTTL is the lifetime of a refresh token; once it has passed,
+// RefreshHandler rejects the token and the holder must sign in again.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// NewJTI returns a random hex-encoded token identifier, suitable for use as
+// a JWT jti or a refresh token/family id.
+func NewJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hex-encoded SHA-256 digest of raw, which is what
+// gets persisted for a refresh token instead of the token itself.
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken mints a fresh opaque refresh token for address, chained
+// to parentJTI/familyID when this is a rotation rather than an initial
+// signin, and returns both the raw token (to hand to the client) and the
+// record to persist.
+func newRefreshToken(address string, parentJTI string, familyID string, mfaVerified bool, roles []string) (string, RefreshToken, error) {
+	rawBytes := make([]byte, 32)
+	if _, err := rand.Read(rawBytes); err != nil {
+		return "", RefreshToken{}, err
+	}
+	raw := hex.EncodeToString(rawBytes)
+
+	jti, err := NewJTI()
+	if err != nil {
+		return "", RefreshToken{}, err
+	}
+	if familyID == "" {
+		familyID = jti
+	}
+
+	now := time.Now()
+	rt := RefreshToken{
+		TokenHash:   HashToken(raw),
+		Address:     address,
+		JTI:         jti,
+		ParentJTI:   parentJTI,
+		FamilyID:    familyID,
+		MFAVerified: mfaVerified,
+		Roles:       roles,
+		IssuedAt:    now,
+		ExpiresAt:   now.Add(refreshTokenTTL),
+	}
+	return raw, rt, nil
+}
+
+// issueTokenPair creates a new access token and a refresh token rotated
+// from parentFamilyID (empty for a fresh signin rather than a rotation)
+// and persists the refresh token.
+func issueTokenPair(storage Storage, jwtProvider *JwtHmacProvider, address string, parentFamilyID string, mfaVerified bool, roles []string) (string, string, error) {
+	accessToken, _, err := jwtProvider.CreateStandard(address, mfaVerified, roles)
+	if err != nil {
+		return "", "", err
+	}
+	rawRefresh, rt, err := newRefreshToken(address, "", parentFamilyID, mfaVerified, roles)
+	if err != nil {
+		return "", "", err
+	}
+	if err := storage.CreateRefreshToken(rt); err != nil {
+		return "", "", err
+	}
+	return accessToken, rawRefresh, nil
+}
+
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh"`
+}
+
+func (p RefreshPayload) Validate() error {
+	if len(p.RefreshToken) == 0 {
+		return ErrMissingSig
+	}
+	return nil
+}
+
+// RefreshHandler verifies the presented refresh token, rotates it, and
+// issues a new access+refresh pair. If the token was already rotated once
+// (i.e. presented again after having been used), that is treated as reuse
+// of a stolen token and the entire rotation family is revoked.
+func RefreshHandler(storage Storage, jwtProvider *JwtHmacProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p RefreshPayload
+		if err := bindReqBody(r, &p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := p.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tokenHash := HashToken(p.RefreshToken)
+		rt, err := storage.GetRefreshToken(tokenHash)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if storage.IsFamilyRevoked(rt.FamilyID) || time.Now().After(rt.ExpiresAt) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// MarkRefreshTokenUsed is the only source of truth for reuse: it
+		// atomically transitions the token to used and tells us whether
+		// we were the one who did it. Two requests racing to redeem the
+		// same token can't both transition it, so whichever one doesn't
+		// is treated as a replay and burns the whole family, closing the
+		// race a prior "is it already used" read-then-write check would
+		// leave open.
+		transitioned, err := storage.MarkRefreshTokenUsed(tokenHash)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !transitioned {
+			storage.RevokeFamily(rt.FamilyID)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		accessToken, _, err := jwtProvider.CreateStandard(rt.Address, rt.MFAVerified, rt.Roles)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rawRefresh, newRt, err := newRefreshToken(rt.Address, rt.JTI, rt.FamilyID, rt.MFAVerified, rt.Roles)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := storage.CreateRefreshToken(newRt); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		resp := struct {
+			AccessToken  string `json:"access"`
+			RefreshToken string `json:"refresh"`
+		}{
+			AccessToken:  accessToken,
+			RefreshToken: rawRefresh,
+		}
+		renderJson(r, w, http.StatusOK, resp)
+	}
+}
+
+// SignoutHandler revokes the presented refresh token's family and the
+// current access token's jti, so both are unusable before their natural
+// expiry.
+func SignoutHandler(storage Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p RefreshPayload
+		if err := bindReqBody(r, &p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(p.RefreshToken) > 0 {
+			rt, err := storage.GetRefreshToken(HashToken(p.RefreshToken))
+			if err == nil {
+				storage.RevokeFamily(rt.FamilyID)
+			}
+		}
+		if jti := getJTIFromReqContext(r); jti != "" {
+			storage.RevokeJTI(jti)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
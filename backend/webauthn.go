@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnCredential is the record persisted for an enrolled passkey. It is
+// address-scoped rather than a free-standing user: the wallet signin
+// already establishes identity, WebAuthn only adds a second factor on top
+// of it.
+type WebAuthnCredential struct {
+	CredentialID    []byte
+	PublicKey       []byte
+	AttestationType string
+	Transports      []string
+	AAGUID          []byte
+	SignCount       uint32
+	CloneWarning    bool
+}
+
+// WebAuthnConfig configures the Relying Party parameters used to build and
+// verify registration/assertion ceremonies.
+type WebAuthnConfig struct {
+	RPDisplayName string
+	RPID          string
+	RPOrigins     []string
+}
+
+// webauthnUser adapts an address and its enrolled credentials to the
+// webauthn.User interface expected by the go-webauthn library.
+type webauthnUser struct {
+	address string
+	creds   []WebAuthnCredential
+}
+
+func (u webauthnUser) WebAuthnID() []byte          { return []byte(u.address) }
+func (u webauthnUser) WebAuthnName() string        { return u.address }
+func (u webauthnUser) WebAuthnDisplayName() string { return u.address }
+func (u webauthnUser) WebAuthnIcon() string        { return "" }
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	out := make([]webauthn.Credential, 0, len(u.creds))
+	for _, c := range u.creds {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(c.Transports))
+		for _, t := range c.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+		out = append(out, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       c.AAGUID,
+				SignCount:    c.SignCount,
+				CloneWarning: c.CloneWarning,
+			},
+		})
+	}
+	return out
+}
+
+func toStoredCredential(cred *webauthn.Credential) WebAuthnCredential {
+	transports := make([]string, 0, len(cred.Transport))
+	for _, t := range cred.Transport {
+		transports = append(transports, string(t))
+	}
+	return WebAuthnCredential{
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		Transports:      transports,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		CloneWarning:    cred.Authenticator.CloneWarning,
+	}
+}
+
+// WebAuthnService holds the go-webauthn Relying Party handle and the
+// in-flight ceremony state (challenges) for registrations/logins that
+// haven't been finished yet. Ceremony state is short-lived by nature (a
+// couple of minutes) so, unlike Storage, it is kept in process memory
+// regardless of which Storage backend is configured.
+type WebAuthnService struct {
+	wa       *webauthn.WebAuthn
+	storage  Storage
+	sessions sync.Map // address -> webauthn.SessionData
+}
+
+func NewWebAuthnService(storage Storage, cfg WebAuthnConfig) (*WebAuthnService, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: cfg.RPDisplayName,
+		RPID:          cfg.RPID,
+		RPOrigins:     cfg.RPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnService{wa: wa, storage: storage}, nil
+}
+
+// RegisterBeginHandler starts enrollment of a new passkey for the caller's
+// already-authenticated (via SIWE) address.
+func (s *WebAuthnService) RegisterBeginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromReqContext(r)
+		creds, err := s.storage.GetWebAuthnCredentials(user.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		creation, session, err := s.wa.BeginRegistration(webauthnUser{address: user.Address, creds: creds})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.sessions.Store(user.Address, *session)
+		renderJson(r, w, http.StatusOK, creation)
+	}
+}
+
+// RegisterFinishHandler verifies the attestation response and stores the
+// resulting credential against the caller's address.
+func (s *WebAuthnService) RegisterFinishHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromReqContext(r)
+		sessionVal, ok := s.sessions.Load(user.Address)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		session := sessionVal.(webauthn.SessionData)
+
+		creds, err := s.storage.GetWebAuthnCredentials(user.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		cred, err := s.wa.FinishRegistration(webauthnUser{address: user.Address, creds: creds}, session, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.sessions.Delete(user.Address)
+
+		if err := s.storage.AddWebAuthnCredential(user.Address, toStoredCredential(cred)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// requirePendingMFA validates the bearer token presented alongside a
+// WebAuthn login request: it must verify as a pending-MFA token (see
+// JwtHmacProvider.CreatePendingMFA) minted for exactly this address. This
+// is what ties the WebAuthn step-up to an already-verified SIWE signature,
+// rather than letting an assertion stand in for the wallet signature.
+func requirePendingMFA(jwtProvider *JwtHmacProvider, storage Storage, r *http.Request, address string) (*AccessClaims, error) {
+	tokenString, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrAuthError
+	}
+	claims, err := jwtProvider.Verify(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != pendingMFAPurpose || claims.Subject != address {
+		return nil, ErrAuthError
+	}
+	if storage.IsJTIRevoked(claims.ID) {
+		return nil, ErrAuthError
+	}
+	return claims, nil
+}
+
+// LoginBeginHandler starts the assertion ceremony for the step-up factor
+// that SigninHandler requires once an address has enrolled credentials.
+// It requires the pending-MFA token SigninHandler issued for address, so
+// the ceremony can't be started without first proving control of the
+// wallet.
+func (s *WebAuthnService) LoginBeginHandler(jwtProvider *JwtHmacProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := strings.ToLower(chi.URLParam(r, "address"))
+		if !hexRegex.MatchString(address) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := requirePendingMFA(jwtProvider, s.storage, r, address); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		creds, err := s.storage.GetWebAuthnCredentials(address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(creds) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assertion, session, err := s.wa.BeginLogin(webauthnUser{address: address, creds: creds})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.sessions.Store(address, *session)
+		renderJson(r, w, http.StatusOK, assertion)
+	}
+}
+
+// LoginFinishHandler verifies the assertion response and, on success,
+// issues an access+refresh pair with the mfa_verified claim set. It
+// requires the same pending-MFA token LoginBeginHandler did, and consumes
+// it so it can't be replayed to mint a second session.
+func (s *WebAuthnService) LoginFinishHandler(jwtProvider *JwtHmacProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := strings.ToLower(chi.URLParam(r, "address"))
+		if !hexRegex.MatchString(address) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mfaClaims, err := requirePendingMFA(jwtProvider, s.storage, r, address)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sessionVal, ok := s.sessions.Load(address)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		session := sessionVal.(webauthn.SessionData)
+
+		creds, err := s.storage.GetWebAuthnCredentials(address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		cred, err := s.wa.FinishLogin(webauthnUser{address: address, creds: creds}, session, r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.sessions.Delete(address)
+
+		if err := s.storage.UpdateWebAuthnSignCount(address, cred.ID, cred.Authenticator.SignCount); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		user, err := s.storage.Get(address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		accessToken, refreshToken, err := issueTokenPair(s.storage, jwtProvider, address, "", true, user.Roles)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Consume the pending-MFA token so it can't be replayed to mint a
+		// second session off the same SIWE signature.
+		s.storage.RevokeJTI(mfaClaims.ID)
+		resp := struct {
+			AccessToken  string `json:"access"`
+			RefreshToken string `json:"refresh"`
+		}{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+		}
+		renderJson(r, w, http.StatusOK, resp)
+	}
+}